@@ -25,10 +25,13 @@
 // return a DelayFn:
 //     - ConstDelay(delay time.Duration) DelayFn
 //     - ExponentialDelay(base, max time.Duration) DelayFn
+//     - ExponentialDelayEqualJitter(base, max time.Duration) DelayFn
+//     - DecorrelatedJitterDelay(base, max time.Duration) DelayFn
 //
 // It also provides common retry predicates that return a ShouldRetryFn:
 //     - RetryTemporaryErr(maxRetries int) ShouldRetryFn
 //     - RetryStatus500(maxRetries int) ShouldRetryFn
+//     - RetryStatuses(maxRetries int, codes ...int) ShouldRetryFn
 //     - RetryHTTPMethods(maxRetries int, methods ...string) ShouldRetryFn
 //
 // Those can be combined with RetryAny or RetryAll as needed. RetryAny
@@ -41,16 +44,29 @@
 // by setting PreventRetryWithBody to true on the Transport. Doing so
 // will disable retries when a request has a non-nil body.
 //
+// Cancelation of a pending retry is handled via the request's Context: if
+// the context passed to the request is canceled or its deadline is
+// exceeded, RoundTrip returns immediately instead of sleeping for the
+// remainder of the backoff delay. A specific request can also be excluded
+// from retries entirely, regardless of ShouldRetryFn, by passing a context
+// wrapped with WithNoRetry.
+//
+// A Transport shared across many requests can be protected from retry
+// amplification during an outage by setting its RetryBudget, e.g. to one
+// returned by NewTokenBucketBudget.
+//
 package rehttp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -61,6 +77,20 @@ import (
 // initialized with a source based on the current time in nanoseconds.
 var PRNG = rand.New(rand.NewSource(time.Now().UnixNano()))
 
+// prngMu guards calls to PRNG made internally by this package's DelayFns,
+// since the *rand.Rand held by PRNG is not itself safe for concurrent use,
+// and a Transport's DelayFn can be called concurrently by retries of
+// different requests sharing that Transport.
+var prngMu sync.Mutex
+
+// randInt63n is a concurrency-safe wrapper around PRNG.Int63n for use by
+// this package's DelayFns.
+func randInt63n(n int64) int64 {
+	prngMu.Lock()
+	defer prngMu.Unlock()
+	return PRNG.Int63n(n)
+}
+
 // terribly named interface to detect errors that support Temporary.
 type temporaryer interface {
 	Temporary() bool
@@ -68,6 +98,10 @@ type temporaryer interface {
 
 // CancelRoundTripper is a RoundTripper that supports CancelRequest.
 // The *http.Transport type implements this interface.
+//
+// Deprecated: CancelRequest is deprecated in net/http in favor of
+// Request.Context(). Transport now accepts a plain http.RoundTripper and
+// relies on the request's context to cancel a pending retry.
 type CancelRoundTripper interface {
 	http.RoundTripper
 	CancelRequest(*http.Request)
@@ -103,22 +137,35 @@ type DelayFn func(attempt Attempt) time.Duration
 // retry should be done for the request.
 type ShouldRetryFn func(attempt Attempt) bool
 
+// noRetryKey is the context key used by WithNoRetry.
+type noRetryKey struct{}
+
+// WithNoRetry returns a copy of ctx that marks the associated request as
+// ineligible for retries on a Transport, regardless of what ShouldRetryFn
+// or RetryBudget would otherwise allow. It is the per-request analog of
+// Transport.PreventRetryWithBody.
+func WithNoRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+// noRetryFromContext reports whether ctx was marked with WithNoRetry.
+func noRetryFromContext(ctx context.Context) bool {
+	noRetry, _ := ctx.Value(noRetryKey{}).(bool)
+	return noRetry
+}
+
 // NewTransport creates a Transport with a retry strategy based on
 // shouldRetry and delay to control the retry logic. It uses the provided
-// CancelRoundTripper to execute the requests. If rt is nil,
-// http.DefaultTransport is used. An error is returned if http.DefaultTransport
-// is not a CancelRoundTripper (which it is by default).
-func NewTransport(rt CancelRoundTripper, shouldRetry ShouldRetryFn, delay DelayFn) (*Transport, error) {
+// http.RoundTripper to execute the requests. If rt is nil,
+// http.DefaultTransport is used. The error return is kept for backwards
+// compatibility with older versions of this package; it is always nil.
+func NewTransport(rt http.RoundTripper, shouldRetry ShouldRetryFn, delay DelayFn) (*Transport, error) {
 	if rt == nil {
-		var ok bool
-		rt, ok = http.DefaultTransport.(CancelRoundTripper)
-		if !ok {
-			return nil, errors.New("http.DefaultTransport is not a CancelRoundTripper")
-		}
+		rt = http.DefaultTransport
 	}
 	return &Transport{
-		CancelRoundTripper: rt,
-		retry:              toRetryFn(shouldRetry, delay),
+		RoundTripper: rt,
+		retry:        toRetryFn(shouldRetry, delay),
 	}, nil
 }
 
@@ -188,6 +235,27 @@ func RetryStatus500(maxRetries int) ShouldRetryFn {
 	}
 }
 
+// RetryStatuses returns a ShouldRetryFn that retries up to maxRetries times
+// for any of the provided status codes. It is meant for targeting a specific
+// set of statuses (e.g. 429, 503, 504) instead of the whole 5xx range covered
+// by RetryStatus500.
+func RetryStatuses(maxRetries int, codes ...int) ShouldRetryFn {
+	return func(attempt Attempt) bool {
+		if attempt.Index >= maxRetries {
+			return false
+		}
+		if attempt.Response == nil {
+			return false
+		}
+		for _, c := range codes {
+			if attempt.Response.StatusCode == c {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // RetryHTTPMethods returns a ShouldRetryFn that retries up to maxRetries
 // times if the request's HTTP method is one of the provided methods.
 // It is meant to be used in conjunction with another ShouldRetryFn such
@@ -229,23 +297,237 @@ func ExponentialDelay(base, max time.Duration) DelayFn {
 		exp := math.Pow(2, float64(attempt.Index))
 		top := float64(base) * exp
 		return time.Duration(
-			PRNG.Int63n(int64(math.Min(float64(max), top))),
+			randInt63n(int64(math.Min(float64(max), top))),
 		)
 	}
 }
 
-// Transport wraps a CancelRoundTripper such as *http.Transport and adds
+// ExponentialDelayEqualJitter returns a DelayFn that returns a delay of half
+// of base * 2^attempt (capped at max), plus a random duration between 0 and
+// that same half. This is the "equal jitter" variant from the AWS
+// Architecture Blog, which keeps a minimum backoff floor while still
+// spreading out retries, unlike the full jitter of ExponentialDelay which
+// can return a delay of 0.
+//
+// See: http://www.awsarchitectureblog.com/2015/03/backoff.html
+func ExponentialDelayEqualJitter(base, max time.Duration) DelayFn {
+	return func(attempt Attempt) time.Duration {
+		exp := math.Pow(2, float64(attempt.Index))
+		temp := math.Min(float64(max), float64(base)*exp) / 2
+		return time.Duration(temp) + time.Duration(randInt63n(int64(temp)))
+	}
+}
+
+// DecorrelatedJitterDelay returns a DelayFn that returns a delay of
+// min(max, rand(base, prev*3)), where prev is the delay returned by the
+// previous call, initialized to base. This is the "decorrelated jitter"
+// variant from the AWS Architecture Blog. Unlike the other delay strategies
+// in this package, the returned DelayFn is stateful: it must be reused
+// across the retries of a single request (as Transport does), and it is
+// safe for concurrent use by multiple requests sharing the same instance.
+//
+// See: http://www.awsarchitectureblog.com/2015/03/backoff.html
+func DecorrelatedJitterDelay(base, max time.Duration) DelayFn {
+	prev := base
+	var mu sync.Mutex
+
+	return func(attempt Attempt) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+
+		next := base
+		if top := prev * 3; top > base {
+			next = base + time.Duration(randInt63n(int64(top-base)))
+		}
+		if next > max {
+			next = max
+		}
+		prev = next
+		return next
+	}
+}
+
+// RetryAfterDelay returns a DelayFn that honors the HTTP Retry-After response
+// header, as seen on 429 (Too Many Requests) and 503 (Service Unavailable)
+// responses. The header may hold either a number of seconds to wait (delta-
+// seconds) or an HTTP-date indicating when to retry; both forms are
+// supported. If the header is absent, invalid, holds zero (or fewer)
+// seconds, or indicates a time in the past, fallback is called to
+// determine the delay instead.
+func RetryAfterDelay(fallback DelayFn) DelayFn {
+	return func(attempt Attempt) time.Duration {
+		if attempt.Response != nil {
+			if v := attempt.Response.Header.Get("Retry-After"); v != "" {
+				if secs, err := strconv.Atoi(v); err == nil {
+					if secs > 0 {
+						return time.Duration(secs) * time.Second
+					}
+				} else if t, err := http.ParseTime(v); err == nil {
+					if d := time.Until(t); d > 0 {
+						return d
+					}
+				}
+			}
+		}
+		return fallback(attempt)
+	}
+}
+
+// RetryBudget limits the aggregate rate of retries a Transport is willing to
+// make, as a defense against retry amplification making an ongoing outage
+// worse. Record is called with the outcome of every attempt made by
+// RoundTrip, and Allow is called whenever ShouldRetryFn would otherwise
+// allow a retry; the retry only proceeds if Allow also returns true.
+// Implementations must be safe for concurrent use, since a Transport may be
+// shared across many in-flight requests.
+type RetryBudget interface {
+	// Allow reports whether a retry may be attempted right now.
+	Allow() bool
+
+	// Record reports the outcome of an attempt, so the budget can track
+	// the request/retry rate it is derived from.
+	Record(success bool)
+}
+
+// retryBudgetWindow is the duration of the sliding window over which
+// tokenBucketBudget computes its request/retry ratio.
+const retryBudgetWindow = 10 * time.Second
+
+// retryBudgetBuckets is the number of buckets retryBudgetWindow is divided
+// into; each bucket covers one second.
+const retryBudgetBuckets = int(retryBudgetWindow / time.Second)
+
+// NewTokenBucketBudget returns a RetryBudget that allows a retry only if
+// doing so keeps the ratio of retries to requests, computed over a sliding
+// 10 second window, under ratio. Independently of the ratio, at least
+// minPerSec retries are allowed every second, so that a Transport serving a
+// low but steady trickle of requests is not starved of retries entirely.
+func NewTokenBucketBudget(ratio float64, minPerSec int) RetryBudget {
+	return &tokenBucketBudget{
+		ratio:     ratio,
+		minPerSec: minPerSec,
+	}
+}
+
+// tokenBucketBudget is the default RetryBudget implementation returned by
+// NewTokenBucketBudget.
+type tokenBucketBudget struct {
+	ratio     float64
+	minPerSec int
+
+	mu      sync.Mutex
+	last    time.Time
+	cur     int
+	buckets [retryBudgetBuckets]struct{ requests, retries int }
+}
+
+// advance rotates the sliding window forward to the current second,
+// clearing out buckets that have fallen outside of it. Callers must hold b.mu.
+func (b *tokenBucketBudget) advance() {
+	now := time.Now()
+	elapsed := retryBudgetBuckets
+	if !b.last.IsZero() {
+		elapsed = int(now.Sub(b.last) / time.Second)
+	}
+	if elapsed > retryBudgetBuckets {
+		elapsed = retryBudgetBuckets
+	}
+	for i := 0; i < elapsed; i++ {
+		b.cur = (b.cur + 1) % retryBudgetBuckets
+		b.buckets[b.cur] = struct{ requests, retries int }{}
+	}
+	if b.last.IsZero() {
+		b.last = now
+	} else {
+		// only move last forward by whole seconds, so that calls less than
+		// a second apart still add up to a rotation
+		b.last = b.last.Add(now.Sub(b.last).Truncate(time.Second))
+	}
+}
+
+func (b *tokenBucketBudget) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+
+	if b.buckets[b.cur].retries < b.minPerSec {
+		b.buckets[b.cur].retries++
+		return true
+	}
+
+	var requests, retries int
+	for _, bk := range b.buckets {
+		requests += bk.requests
+		retries += bk.retries
+	}
+	if requests == 0 || float64(retries+1)/float64(requests) > b.ratio {
+		return false
+	}
+	b.buckets[b.cur].retries++
+	return true
+}
+
+// Record counts the attempt towards the sliding window's request total. The
+// success flag is intentionally ignored: the ratio this budget enforces is
+// retries over total traffic, not a success rate, so a failed attempt counts
+// the same as a successful one towards the denominator.
+func (b *tokenBucketBudget) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+	b.buckets[b.cur].requests++
+}
+
+// Transport wraps an http.RoundTripper such as *http.Transport and adds
 // retry logic.
 type Transport struct {
-	CancelRoundTripper
+	http.RoundTripper
 
 	// PreventRetryWithBody prevents retrying if the request has a body. Since
 	// the body is consumed on a request attempt, in order to retry a request
-	// with a body, the body has to be buffered in memory. Setting this
-	// to true avoids this buffering: the retry logic is bypassed if a body
-	// is present.
+	// with a body, the body has to be replayed, either via Request.GetBody,
+	// BodyReaderFactory, or by buffering it in memory. Setting this to true
+	// bypasses all of that: the retry logic is disabled if a body is present.
 	PreventRetryWithBody bool
 
+	// BodyReaderFactory, if set, is called to obtain a fresh body for each
+	// retry of a request that has one. It is used in preference to buffering
+	// the body in memory, but only if Request.GetBody is not set (GetBody is
+	// populated by net/http for common body types such as *bytes.Buffer,
+	// *bytes.Reader and *strings.Reader, and always takes precedence). This
+	// is meant for streaming bodies that cannot be replayed by simply
+	// re-reading a buffer, such as ones backed by a file on disk.
+	BodyReaderFactory func() (io.ReadCloser, error)
+
+	// ResponseHandler, if set, is called after each attempt with the
+	// attempt's response body already buffered and readable from
+	// attempt.Response.Body. This allows a ShouldRetryFn to base its
+	// decision on the body itself, not just the status code or headers,
+	// e.g. an API that returns HTTP 200 with a JSON {"error": "throttled"}
+	// payload, or one whose body stream fails mid-read. If ResponseHandler
+	// returns a non-nil error, that error is used in place of the attempt's
+	// original error (if any) when evaluating ShouldRetryFn. Buffering only
+	// happens when ResponseHandler is set, and up to MaxResponseBodyBuffer
+	// bytes. It is not called for an attempt that returned no response, nor
+	// for a request whose retries are prevented by PreventRetryWithBody or
+	// WithNoRetry. If reading the body fails, it is not called either, and
+	// the read error is used as the attempt's error instead.
+	ResponseHandler func(attempt Attempt) error
+
+	// MaxResponseBodyBuffer caps the number of response body bytes buffered
+	// for ResponseHandler, in bytes. A value of 0 (the default) buffers the
+	// whole body. It has no effect if ResponseHandler is nil.
+	MaxResponseBodyBuffer int64
+
+	// RetryBudget, if set, caps the aggregate rate of retries across all
+	// requests sharing this Transport, so that retries cannot make an
+	// ongoing outage worse. Each attempt is recorded with RetryBudget.Record,
+	// and a retry that ShouldRetryFn would otherwise allow is only attempted
+	// if RetryBudget.Allow also returns true. When it returns false,
+	// RoundTrip returns the last response/error immediately, regardless of
+	// what ShouldRetryFn says.
+	RetryBudget RetryBudget
+
 	// retry is a function that determines if the request should be retried.
 	// Unless a retry is prevented based on PreventRetryWithBody, all requests
 	// go through that function, even those that are typically considered
@@ -255,6 +537,11 @@ type Transport struct {
 	// attempted after the specified duration.
 	retry retryFn
 
+	// mu and reqCh only back the deprecated CancelRequest method; pending
+	// retries are otherwise canceled via the request's context.
+	//
+	// Deprecated: cancel the request's context instead of calling
+	// CancelRequest.
 	mu    sync.Mutex
 	reqCh map[*http.Request]chan struct{}
 }
@@ -264,7 +551,7 @@ type Transport struct {
 // adds retry logic as per its configuration.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	var attempt int
-	preventRetry := req.Body != nil && t.PreventRetryWithBody
+	preventRetry := (req.Body != nil && t.PreventRetryWithBody) || noRetryFromContext(req.Context())
 
 	ch := make(chan struct{})
 	t.mu.Lock()
@@ -280,9 +567,17 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		t.mu.Unlock()
 	}()
 
-	// buffer the body if needed
+	// prefer GetBody (set by net/http for common body types) or the
+	// BodyReaderFactory hook to obtain a fresh body on each retry, and
+	// fall back to buffering the whole body in memory only if neither
+	// is available.
+	getBody := req.GetBody
+	if getBody == nil && t.BodyReaderFactory != nil && req.Body != nil {
+		getBody = t.BodyReaderFactory
+	}
+
 	var br *bytes.Reader
-	if req.Body != nil && !preventRetry {
+	if req.Body != nil && !preventRetry && getBody == nil {
 		var buf bytes.Buffer
 		if _, err := io.Copy(&buf, req.Body); err != nil {
 			// cannot even try the first attempt, body has been consumed
@@ -296,30 +591,94 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 
 	for {
-		res, err := t.CancelRoundTripper.RoundTrip(req)
-		if preventRetry {
-			return res, err
+		res, err := t.RoundTripper.RoundTrip(req)
+
+		if !preventRetry && t.ResponseHandler != nil && res != nil && res.Body != nil {
+			// Only the copy handed to ResponseHandler is bounded by
+			// MaxResponseBodyBuffer. The body handed back below, for the
+			// retry decision and ultimately the caller, is always
+			// reconstructed in full by chaining that buffered prefix with
+			// whatever remains unread on the original body, which is left
+			// open and closed only when the reconstructed body is.
+			origBody := res.Body
+			var buf bytes.Buffer
+			var bodyReader io.Reader = origBody
+			if t.MaxResponseBodyBuffer > 0 {
+				bodyReader = io.LimitReader(origBody, t.MaxResponseBodyBuffer)
+			}
+			_, copyErr := io.Copy(&buf, bodyReader)
+
+			if copyErr != nil {
+				err = copyErr
+			} else {
+				res.Body = ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
+				if herr := t.ResponseHandler(Attempt{
+					Request:  req,
+					Response: res,
+					Index:    attempt,
+					Error:    err,
+				}); herr != nil {
+					err = herr
+				}
+			}
+
+			res.Body = struct {
+				io.Reader
+				io.Closer
+			}{
+				Reader: io.MultiReader(bytes.NewReader(buf.Bytes()), origBody),
+				Closer: origBody,
+			}
 		}
 
-		retry, delay := t.retry(Attempt{
-			Request:  req,
-			Response: res,
-			Index:    attempt,
-			Error:    err,
-		})
-		if !retry {
+		var retry bool
+		var delay time.Duration
+		if !preventRetry {
+			retry, delay = t.retry(Attempt{
+				Request:  req,
+				Response: res,
+				Index:    attempt,
+				Error:    err,
+			})
+		}
+		if t.RetryBudget != nil {
+			// Record is called for every attempt RoundTrip makes, including
+			// ones where retry is already known to be impossible (e.g.
+			// PreventRetryWithBody or WithNoRetry), so the sliding window's
+			// request total reflects all traffic sharing this Transport, not
+			// just the subset that was eligible for a retry.
+			//
+			// success reflects whether this attempt actually succeeded, as
+			// opposed to whether a retry will be attempted: an attempt that
+			// exhausted maxRetries while still failing (e.g. a persistent
+			// 500 on the last try) is not a success just because no further
+			// retry follows.
+			success := err == nil && (res == nil || res.StatusCode < 500)
+			t.RetryBudget.Record(success)
+			if retry && !t.RetryBudget.Allow() {
+				retry = false
+			}
+		}
+		if preventRetry || !retry {
 			return res, err
 		}
 
+		// Per Go's doc: "RoundTrip should not modify the request, except
+		// for consuming and closing the Body", so the only thing to reset
+		// on the request is the body, if any.
 		if br != nil {
-			// Per Go's doc: "RoundTrip should not modify the request,
-			// except for consuming and closing the Body", so the only thing
-			// to reset on the request is the body, if any.
 			if _, serr := br.Seek(0, 0); serr != nil {
 				// failed to retry, return the results
 				return res, err
 			}
 			req.Body = ioutil.NopCloser(br)
+		} else if getBody != nil {
+			body, berr := getBody()
+			if berr != nil {
+				// failed to retry, return the results
+				return res, err
+			}
+			req.Body = body
 		}
 		// close the disposed response's body, if any
 		if res != nil {
@@ -330,8 +689,12 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		select {
 		case <-time.After(delay):
 			attempt++
+		case <-req.Context().Done():
+			// request canceled by caller via its context, don't retry
+			return nil, req.Context().Err()
 		case <-req.Cancel:
-			// request canceled by caller, don't retry
+			// request canceled by caller via the legacy Cancel channel,
+			// don't retry
 			return nil, errors.New("net/http: request canceled")
 		case <-ch:
 			// request canceled by call to CancelRequest, don't retry
@@ -342,6 +705,11 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 // CancelRequest cancels the specified request, preventing any pending
 // retry.
+//
+// Deprecated: use the request's context for cancellation instead (see
+// Request.WithContext). CancelRequest always aborts a pending retry, but it
+// only cancels an attempt in flight if the underlying http.RoundTripper is
+// a CancelRoundTripper.
 func (t *Transport) CancelRequest(req *http.Request) {
 	var ch chan struct{}
 	t.mu.Lock()
@@ -355,5 +723,7 @@ func (t *Transport) CancelRequest(req *http.Request) {
 		close(ch)
 	}
 
-	t.CancelRoundTripper.CancelRequest(req)
+	if canceler, ok := t.RoundTripper.(CancelRoundTripper); ok {
+		canceler.CancelRequest(req)
+	}
 }
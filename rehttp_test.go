@@ -1,7 +1,12 @@
 package rehttp
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -9,49 +14,34 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestNoDelay(t *testing.T) {
-	fn := NoDelay()
-	want := time.Duration(0)
-	for i := 0; i < 5; i++ {
-		delay := fn(nil, nil, i, nil)
-		assert.Equal(t, want, delay, "%d", i)
-	}
+// rtFunc adapts a plain function to the http.RoundTripper interface, so
+// tests can stub out the underlying transport without a real network call.
+type rtFunc func(*http.Request) (*http.Response, error)
+
+func (f rtFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
 }
 
 func TestConstDelay(t *testing.T) {
 	want := 2 * time.Second
 	fn := ConstDelay(want)
 	for i := 0; i < 5; i++ {
-		delay := fn(nil, nil, i, nil)
+		delay := fn(Attempt{Index: i})
 		assert.Equal(t, want, delay, "%d", i)
 	}
 }
 
-func TestLinearDelay(t *testing.T) {
-	initial := 2 * time.Second
-	fn := LinearDelay(initial)
-	want := []time.Duration{2 * time.Second, 4 * time.Second, 6 * time.Second, 8 * time.Second, 10 * time.Second}
-	for i := 0; i < len(want); i++ {
-		got := fn(nil, nil, i, nil)
-		assert.Equal(t, want[i], got, "%d", i)
-	}
-}
-
 func TestExponentialDelay(t *testing.T) {
-	initial := 2 * time.Second
-	fn := ExponentialDelay(initial, time.Second)
-	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second}
-	for i := 0; i < len(want); i++ {
-		got := fn(nil, nil, i, nil)
-		assert.Equal(t, want[i], got, "%d", i)
-	}
-
-	initial = 100 * time.Millisecond
-	fn = ExponentialDelay(initial, 10*time.Millisecond)
-	want = []time.Duration{100 * time.Millisecond, time.Second, 10 * time.Second}
-	for i := 0; i < len(want); i++ {
-		got := fn(nil, nil, i, nil)
-		assert.Equal(t, want[i], got, "%d", i)
+	base := 2 * time.Second
+	max := 40 * time.Second
+	fn := ExponentialDelay(base, max)
+	for i := 0; i < 5; i++ {
+		top := base * time.Duration(1<<uint(i))
+		if top > max {
+			top = max
+		}
+		got := fn(Attempt{Index: i})
+		assert.True(t, got >= 0 && got < top, "%d: got %s, want [0, %s)", i, got, top)
 	}
 }
 
@@ -79,11 +69,371 @@ func TestRetryHTTPMethods(t *testing.T) {
 		fn := RetryHTTPMethods(tc.retries, tc.meths...)
 		req, err := http.NewRequest(tc.inMeth, "", nil)
 		require.Nil(t, err)
-		got := fn(req, nil, tc.att, nil)
+		got := fn(Attempt{Request: req, Index: tc.att})
 		assert.Equal(t, tc.want, got, "%d", i)
 	}
 }
 
 func TestRetryStatus500(t *testing.T) {
+	cases := []struct {
+		retries int
+		status  int
+		att     int
+		want    bool
+	}{
+		{retries: 1, status: 500, att: 0, want: true},
+		{retries: 1, status: 599, att: 0, want: true},
+		{retries: 1, status: 500, att: 1, want: false},
+		{retries: 1, status: 404, att: 0, want: false},
+		{retries: 1, status: 200, att: 0, want: false},
+	}
+
+	for i, tc := range cases {
+		fn := RetryStatus500(tc.retries)
+		got := fn(Attempt{Response: &http.Response{StatusCode: tc.status}, Index: tc.att})
+		assert.Equal(t, tc.want, got, "%d", i)
+	}
+}
+
+func TestRetryStatuses(t *testing.T) {
+	cases := []struct {
+		retries int
+		codes   []int
+		status  int
+		att     int
+		want    bool
+	}{
+		{retries: 1, codes: []int{429, 503}, status: 429, att: 0, want: true},
+		{retries: 1, codes: []int{429, 503}, status: 503, att: 0, want: true},
+		{retries: 1, codes: []int{429, 503}, status: 500, att: 0, want: false},
+		{retries: 1, codes: []int{429}, status: 429, att: 1, want: false},
+	}
+
+	for i, tc := range cases {
+		fn := RetryStatuses(tc.retries, tc.codes...)
+		got := fn(Attempt{Response: &http.Response{StatusCode: tc.status}, Index: tc.att})
+		assert.Equal(t, tc.want, got, "%d", i)
+	}
+}
+
+func TestRetryAfterDelay(t *testing.T) {
+	fallback := ConstDelay(time.Minute)
+
+	cases := []struct {
+		desc   string
+		header string
+		want   time.Duration
+	}{
+		{desc: "no header", header: "", want: time.Minute},
+		{desc: "delta-seconds", header: "5", want: 5 * time.Second},
+		{desc: "zero delta-seconds falls back", header: "0", want: time.Minute},
+		{desc: "future HTTP-date", header: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), want: 10 * time.Second},
+		{desc: "past HTTP-date falls back", header: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), want: time.Minute},
+		{desc: "garbage falls back", header: "not-a-valid-value", want: time.Minute},
+	}
+
+	for _, tc := range cases {
+		res := &http.Response{Header: http.Header{}}
+		if tc.header != "" {
+			res.Header.Set("Retry-After", tc.header)
+		}
+		fn := RetryAfterDelay(fallback)
+		got := fn(Attempt{Response: res})
+		// allow a little slack for the future HTTP-date case, which loses
+		// sub-second precision when formatted.
+		diff := got - tc.want
+		if diff < 0 {
+			diff = -diff
+		}
+		assert.True(t, diff <= time.Second, "%s: got %s, want ~%s", tc.desc, got, tc.want)
+	}
+}
+
+// unrecognizedReader is an io.Reader that net/http does not special-case, so
+// passing it to http.NewRequest leaves Request.GetBody unset.
+type unrecognizedReader struct {
+	s string
+	i int
+}
+
+func (r *unrecognizedReader) Read(p []byte) (int, error) {
+	if r.i >= len(r.s) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.s[r.i:])
+	r.i += n
+	return n, nil
+}
+
+func newFailNTimesThenSucceed(n int, bodies *[]string) rtFunc {
+	calls := 0
+	return func(req *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(req.Body)
+		*bodies = append(*bodies, string(b))
+		calls++
+		status := 200
+		if calls <= n {
+			status = 500
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+}
+
+func TestTransportGetBodyReplay(t *testing.T) {
+	var bodies []string
+	rt := newFailNTimesThenSucceed(2, &bodies)
+
+	tr, err := NewTransport(rt, RetryStatus500(5), ConstDelay(0))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.NotNil(t, req.GetBody, "http.NewRequest should have set GetBody for a strings.Reader body")
+
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []string{"hello", "hello", "hello"}, bodies)
+}
+
+func TestTransportContextCancelAbortsPendingRetry(t *testing.T) {
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 500, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+	tr, err := NewTransport(rt, RetryStatus500(100), ConstDelay(time.Minute))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = tr.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	require.Error(t, err)
+	assert.True(t, elapsed < time.Second, "RoundTrip should return promptly once the context is canceled, took %s", elapsed)
+}
+
+func TestTransportBodyReaderFactoryReplay(t *testing.T) {
+	var bodies []string
+	rt := newFailNTimesThenSucceed(2, &bodies)
+
+	tr, err := NewTransport(rt, RetryStatus500(5), ConstDelay(0))
+	require.NoError(t, err)
+	tr.BodyReaderFactory = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(&unrecognizedReader{s: "hello"}), nil
+	}
+
+	req, err := http.NewRequest("POST", "http://example.com", &unrecognizedReader{s: "hello"})
+	require.NoError(t, err)
+	require.Nil(t, req.GetBody, "GetBody should not be set for an unrecognized body type")
+
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []string{"hello", "hello", "hello"}, bodies)
+}
+
+// temporaryErr is an error that implements the Temporary() bool method
+// expected by RetryTemporaryErr.
+type temporaryErr struct{ msg string }
+
+func (e temporaryErr) Error() string   { return e.msg }
+func (e temporaryErr) Temporary() bool { return true }
+
+func TestTransportResponseHandlerDrivenRetry(t *testing.T) {
+	calls := 0
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		body := `{"error":"throttled"}`
+		if calls > 1 {
+			body = `{"ok":true}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	})
+
+	tr, err := NewTransport(rt, RetryTemporaryErr(3), ConstDelay(0))
+	require.NoError(t, err)
+	tr.ResponseHandler = func(attempt Attempt) error {
+		b, _ := ioutil.ReadAll(attempt.Response.Body)
+		if strings.Contains(string(b), "throttled") {
+			return temporaryErr{msg: "throttled"}
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	require.NoError(t, err)
+
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"ok":true}`, string(b))
+}
+
+func TestTransportResponseHandlerDoesNotTruncateBody(t *testing.T) {
+	full := strings.Repeat("x", 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(full))
+	}))
+	defer srv.Close()
+
+	tr, err := NewTransport(nil, RetryStatus500(3), ConstDelay(0))
+	require.NoError(t, err)
+	tr.ResponseHandler = func(attempt Attempt) error { return nil }
+	tr.MaxResponseBodyBuffer = 10
+
+	client := &http.Client{Transport: tr}
+	res, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	got, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, full, string(got))
+}
+
+func TestExponentialDelayEqualJitter(t *testing.T) {
+	base := 2 * time.Second
+	max := 40 * time.Second
+	fn := ExponentialDelayEqualJitter(base, max)
+	for i := 0; i < 5; i++ {
+		top := base * time.Duration(1<<uint(i))
+		if top > max {
+			top = max
+		}
+		half := top / 2
+		got := fn(Attempt{Index: i})
+		assert.True(t, got >= half && got < top, "%d: got %s, want [%s, %s)", i, got, half, top)
+	}
+}
+
+func TestDecorrelatedJitterDelay(t *testing.T) {
+	base := time.Second
+	max := 30 * time.Second
+	fn := DecorrelatedJitterDelay(base, max)
+
+	prev := base
+	for i := 0; i < 10; i++ {
+		got := fn(Attempt{Index: i})
+		assert.True(t, got >= base, "%d: got %s, want >= %s", i, got, base)
+		assert.True(t, got <= max, "%d: got %s, want <= %s", i, got, max)
+
+		top := prev * 3
+		if top > max {
+			top = max
+		}
+		assert.True(t, got <= top, "%d: got %s, want <= %s", i, got, top)
+		prev = got
+	}
+}
+
+func TestWithNoRetry(t *testing.T) {
+	calls := 0
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 500, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+	tr, err := NewTransport(rt, RetryStatus500(5), ConstDelay(0))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	require.NoError(t, err)
+	req = req.WithContext(WithNoRetry(context.Background()))
+
+	res, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Equal(t, 1, calls, "WithNoRetry should prevent any retry even though ShouldRetryFn allows one")
+}
+
+func TestTokenBucketBudgetRatio(t *testing.T) {
+	budget := NewTokenBucketBudget(0.1, 0)
+	allowed := 0
+	const n = 1000
+	for i := 0; i < n; i++ {
+		budget.Record(false)
+		if budget.Allow() {
+			allowed++
+		}
+	}
+	assert.True(t, float64(allowed)/float64(n) <= 0.15, "allowed %d/%d retries, want around the 10%% ratio", allowed, n)
+}
+
+func TestTokenBucketBudgetMinPerSec(t *testing.T) {
+	budget := NewTokenBucketBudget(0, 5)
+	budget.Record(false)
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if budget.Allow() {
+			allowed++
+		}
+	}
+	assert.Equal(t, 5, allowed, "minPerSec should guarantee at least 5 retries regardless of ratio")
+	assert.False(t, budget.Allow(), "a 6th retry should be denied once the per-second floor is exhausted")
+}
+
+// countingBudget is a stub RetryBudget that always allows a retry, and
+// merely counts how many times Record is called, so tests can assert on
+// whether RoundTrip recorded an attempt without exercising the ratio logic
+// of tokenBucketBudget.
+type countingBudget struct {
+	records int
+}
+
+func (b *countingBudget) Allow() bool         { return true }
+func (b *countingBudget) Record(success bool) { b.records++ }
+
+func TestRetryBudgetRecordsAttemptsExcludedFromRetry(t *testing.T) {
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	t.Run("PreventRetryWithBody", func(t *testing.T) {
+		tr, err := NewTransport(rt, RetryAny(), ConstDelay(0))
+		require.NoError(t, err)
+		tr.PreventRetryWithBody = true
+		budget := &countingBudget{}
+		tr.RetryBudget = budget
+
+		req, err := http.NewRequest("POST", "http://example.com", strings.NewReader("body"))
+		require.NoError(t, err)
+
+		_, err = tr.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 1, budget.records, "the attempt should still be recorded even though a retry was never possible")
+	})
+
+	t.Run("WithNoRetry", func(t *testing.T) {
+		tr, err := NewTransport(rt, RetryAny(), ConstDelay(0))
+		require.NoError(t, err)
+		budget := &countingBudget{}
+		tr.RetryBudget = budget
+
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		require.NoError(t, err)
+		req = req.WithContext(WithNoRetry(context.Background()))
 
+		_, err = tr.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 1, budget.records, "the attempt should still be recorded even though a retry was never possible")
+	})
 }